@@ -16,15 +16,58 @@ type Config struct {
 	// Username is the name of the target user.
 	Username string
 
-	// Stdin is the input stream which the conversation function will use to
-	// obtain data from the user.
+	// UsePAMAuth specifies whether to trigger the "auth" PAM stack
+	// (pam_authenticate and pam_setcred) in addition to the "account" and
+	// "session" stacks. When false, Teleport only uses PAM for its
+	// traditional account/session side effects and performs no PAM-based
+	// authentication.
+	UsePAMAuth bool
+
+	// CredentialsFlag is the flag passed to pam_setcred when establishing
+	// credentials after a successful pam_authenticate call. If unset, it
+	// defaults to PAM_ESTABLISH_CRED.
+	CredentialsFlag int
+
+	// RemoteHost is the address of the remote host the user is connecting
+	// from. It is set as PAM_RHOST so modules like pam_access and
+	// pam_tally2 can make decisions based on the origin of the connection.
+	// The caller (the SSH server handling the connection) is responsible
+	// for populating this from the client's remote address.
+	RemoteHost string
+
+	// RemoteUser is the name of the user on the remote host, if known. It
+	// is set as PAM_RUSER.
+	RemoteUser string
+
+	// TTYName is the name of the TTY the session is attached to (or
+	// equivalent, such as a pseudo-terminal device). It is set as PAM_TTY.
+	TTYName string
+
+	// XDisplay is the name of the X11 display the session is associated
+	// with, if any. It is set as PAM_XDISPLAY so modules like pam_access
+	// can apply X11-display-based access rules.
+	XDisplay string
+
+	// AllowPasswordChange controls whether Teleport will respond to an
+	// expired password (PAM_NEW_AUTHTOK_REQD from pam_acct_mgmt) by driving
+	// the module's password-change prompts via pam_chauthtok, instead of
+	// failing the login outright.
+	AllowPasswordChange bool
+
+	// Conversation drives the PAM conversation: prompts, informational
+	// text, and error messages. If nil, a StreamConversation wrapping
+	// Stdin, Stdout, and Stderr is used.
+	Conversation ConversationHandler
+
+	// Stdin is the input stream used to build the default StreamConversation
+	// when Conversation is not set.
 	Stdin io.Reader
 
-	// Stdout is the output stream which the conversation function will use to
-	// show data to the user.
+	// Stdout is the output stream used to build the default
+	// StreamConversation when Conversation is not set.
 	Stdout io.Writer
 
-	// Stderr is the output stream which the conversation function will use to
-	// report errors to the user.
+	// Stderr is the output stream used to build the default
+	// StreamConversation when Conversation is not set.
 	Stderr io.Writer
 }
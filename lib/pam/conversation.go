@@ -0,0 +1,186 @@
+package pam
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/gravitational/trace"
+
+	"golang.org/x/crypto/ssh/terminal"
+)
+
+// ConversationHandler is used to drive a PAM conversation: the back-and-forth
+// between Teleport and whatever PAM modules are configured in the policy
+// named by Config.ServiceName. Every message a PAM module emits has one of
+// four styles, which map onto the four methods below:
+//
+//	PAM_PROMPT_ECHO_ON  -> PromptEchoOn
+//	PAM_PROMPT_ECHO_OFF -> PromptEchoOff
+//	PAM_TEXT_INFO       -> TextInfo
+//	PAM_ERROR_MSG       -> ErrorMsg
+//
+// Implementations can back this with a terminal (StreamConversation), a
+// fixed set of scripted answers (ScriptedConversation), or something
+// richer like an SSH keyboard-interactive exchange or a web socket.
+type ConversationHandler interface {
+	// PromptEchoOn prompts the user for input and echoes the input back to
+	// them (for example a username).
+	PromptEchoOn(msg string) (string, error)
+
+	// PromptEchoOff prompts the user for input without echoing the input
+	// back to them (for example a password).
+	PromptEchoOff(msg string) (string, error)
+
+	// TextInfo shows informational text to the user (for example the
+	// MOTD). No response is expected.
+	TextInfo(msg string)
+
+	// ErrorMsg shows an error message to the user. No response is expected.
+	ErrorMsg(msg string)
+}
+
+// StreamConversation is the default ConversationHandler. It prompts on
+// Stdout and reads responses from Stdin, which is how Teleport drove PAM
+// before ConversationHandler existed.
+//
+// Known limitation: StreamConversation can only suppress echo when Stdin
+// is backed by a real terminal device (see PromptEchoOff). When PAM is
+// driven over a pipe or channel instead of a terminal -- for example an
+// SSH keyboard-interactive exchange -- there is no local terminal
+// discipline for it to disable, so it writes no indication that the
+// answer should be hidden. That case needs its own ConversationHandler
+// that marks the prompt as non-echoing over whatever protocol it's
+// speaking (e.g. the per-prompt echo flag in SSH keyboard-interactive);
+// the PromptEchoOff call itself, rather than PromptEchoOn, is the signal
+// such a handler acts on.
+type StreamConversation struct {
+	// Stdin is the input stream used to read responses to prompts.
+	Stdin io.Reader
+
+	// Stdout is the output stream used to show prompts and informational
+	// text.
+	Stdout io.Writer
+
+	// Stderr is the output stream used to show error messages.
+	Stderr io.Writer
+
+	// reader buffers Stdin across prompts so that an answer typed ahead of
+	// a later prompt isn't dropped when that prompt is read.
+	reader *bufio.Reader
+}
+
+// PromptEchoOn prompts the user for input and echoes the input back to them.
+func (s *StreamConversation) PromptEchoOn(msg string) (string, error) {
+	return s.prompt(msg, true)
+}
+
+// PromptEchoOff prompts the user for input without echoing the input back to
+// them. If Stdin is attached to a terminal, the terminal's echo is disabled
+// for the duration of the read so the answer (typically a password) never
+// appears on screen. An answer that was typed ahead and is already buffered
+// from an earlier prompt is returned from the buffer as is. If Stdin is not
+// a terminal (a pipe or channel), this is a no-op beyond the plain read --
+// see the known limitation on StreamConversation.
+func (s *StreamConversation) PromptEchoOff(msg string) (string, error) {
+	return s.prompt(msg, false)
+}
+
+// TextInfo shows informational text on Stdout.
+func (s *StreamConversation) TextInfo(msg string) {
+	s.writeMessage(s.Stdout, msg)
+}
+
+// ErrorMsg shows an error message on Stderr.
+func (s *StreamConversation) ErrorMsg(msg string) {
+	s.writeMessage(s.Stderr, msg)
+}
+
+func (s *StreamConversation) prompt(msg string, echo bool) (string, error) {
+	if msg != "" {
+		if _, err := s.writeMessage(s.Stdout, msg); err != nil {
+			return "", trace.Wrap(err)
+		}
+	}
+
+	// Only take the raw-terminal path when s.reader holds no buffered
+	// bytes. If it does, they were typed ahead of this prompt; reading raw
+	// off the fd here would bypass that buffer and silently drop or
+	// misalign them.
+	if !echo && (s.reader == nil || s.reader.Buffered() == 0) {
+		if f, ok := s.Stdin.(*os.File); ok && terminal.IsTerminal(int(f.Fd())) {
+			line, err := terminal.ReadPassword(int(f.Fd()))
+			if err != nil {
+				return "", trace.Wrap(err)
+			}
+			return string(line), nil
+		}
+	}
+
+	if s.reader == nil {
+		s.reader = bufio.NewReader(s.Stdin)
+	}
+	text, err := s.reader.ReadString('\n')
+	if err != nil {
+		return "", trace.Wrap(err)
+	}
+
+	return strings.TrimSuffix(text, "\n"), nil
+}
+
+func (s *StreamConversation) writeMessage(w io.Writer, msg string) (int, error) {
+	// Replace \n with \r\n so the message correctly aligned.
+	return w.Write(bytes.Replace([]byte(msg), []byte("\n"), []byte("\r\n"), -1))
+}
+
+// ScriptedConversation is a ConversationHandler driven by a fixed set of
+// answers instead of a terminal. It is intended for tests and other
+// non-interactive automation where the set of prompts a PAM policy will ask
+// is known ahead of time.
+type ScriptedConversation struct {
+	// EchoResponses are returned, in order, from successive PromptEchoOn
+	// calls.
+	EchoResponses []string
+
+	// NoEchoResponses are returned, in order, from successive
+	// PromptEchoOff calls.
+	NoEchoResponses []string
+
+	// Info collects every message passed to TextInfo, in order.
+	Info []string
+
+	// Errors collects every message passed to ErrorMsg, in order.
+	Errors []string
+}
+
+// PromptEchoOn returns the next scripted echo response.
+func (s *ScriptedConversation) PromptEchoOn(msg string) (string, error) {
+	if len(s.EchoResponses) == 0 {
+		return "", trace.BadParameter("no scripted response for echo prompt: %v", msg)
+	}
+	response := s.EchoResponses[0]
+	s.EchoResponses = s.EchoResponses[1:]
+	return response, nil
+}
+
+// PromptEchoOff returns the next scripted no-echo response.
+func (s *ScriptedConversation) PromptEchoOff(msg string) (string, error) {
+	if len(s.NoEchoResponses) == 0 {
+		return "", trace.BadParameter("no scripted response for prompt: %v", msg)
+	}
+	response := s.NoEchoResponses[0]
+	s.NoEchoResponses = s.NoEchoResponses[1:]
+	return response, nil
+}
+
+// TextInfo records msg in Info.
+func (s *ScriptedConversation) TextInfo(msg string) {
+	s.Info = append(s.Info, msg)
+}
+
+// ErrorMsg records msg in Errors.
+func (s *ScriptedConversation) ErrorMsg(msg string) {
+	s.Errors = append(s.Errors, msg)
+}
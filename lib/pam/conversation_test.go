@@ -0,0 +1,114 @@
+package pam
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestStreamConversationPrompt(t *testing.T) {
+	stdin := strings.NewReader("alice\nsecret\n")
+	stdout := &bytes.Buffer{}
+	s := &StreamConversation{Stdin: stdin, Stdout: stdout}
+
+	answer, err := s.PromptEchoOn("login: ")
+	if err != nil {
+		t.Fatalf("PromptEchoOn returned error: %v", err)
+	}
+	if answer != "alice" {
+		t.Errorf("PromptEchoOn answer = %q, want %q", answer, "alice")
+	}
+	if got, want := stdout.String(), "login: "; got != want {
+		t.Errorf("stdout after PromptEchoOn = %q, want %q", got, want)
+	}
+
+	// A second prompt must read from where the first one left off, not
+	// re-wrap Stdin in a fresh reader (which would drop the buffered
+	// "secret\n" already read off the underlying reader by the first
+	// bufio.Reader).
+	answer, err = s.PromptEchoOff("password: ")
+	if err != nil {
+		t.Fatalf("PromptEchoOff returned error: %v", err)
+	}
+	if answer != "secret" {
+		t.Errorf("PromptEchoOff answer = %q, want %q", answer, "secret")
+	}
+}
+
+func TestStreamConversationPromptTrimsTrailingNewline(t *testing.T) {
+	s := &StreamConversation{Stdin: strings.NewReader("hello\n"), Stdout: &bytes.Buffer{}}
+
+	answer, err := s.PromptEchoOn("")
+	if err != nil {
+		t.Fatalf("PromptEchoOn returned error: %v", err)
+	}
+	if answer != "hello" {
+		t.Errorf("answer = %q, want %q (trailing newline should be trimmed)", answer, "hello")
+	}
+}
+
+func TestStreamConversationWriteMessageConvertsNewlines(t *testing.T) {
+	stdout := &bytes.Buffer{}
+	s := &StreamConversation{Stdout: stdout}
+
+	s.TextInfo("line one\nline two")
+
+	if got, want := stdout.String(), "line one\r\nline two"; got != want {
+		t.Errorf("TextInfo output = %q, want %q", got, want)
+	}
+}
+
+func TestStreamConversationErrorMsgWritesToStderr(t *testing.T) {
+	stderr := &bytes.Buffer{}
+	s := &StreamConversation{Stderr: stderr}
+
+	s.ErrorMsg("account expired")
+
+	if got, want := stderr.String(), "account expired"; got != want {
+		t.Errorf("stderr = %q, want %q", got, want)
+	}
+}
+
+func TestScriptedConversationEchoResponses(t *testing.T) {
+	s := &ScriptedConversation{
+		EchoResponses:   []string{"alice"},
+		NoEchoResponses: []string{"secret"},
+	}
+
+	answer, err := s.PromptEchoOn("login: ")
+	if err != nil {
+		t.Fatalf("PromptEchoOn returned error: %v", err)
+	}
+	if answer != "alice" {
+		t.Errorf("PromptEchoOn answer = %q, want %q", answer, "alice")
+	}
+
+	answer, err = s.PromptEchoOff("password: ")
+	if err != nil {
+		t.Fatalf("PromptEchoOff returned error: %v", err)
+	}
+	if answer != "secret" {
+		t.Errorf("PromptEchoOff answer = %q, want %q", answer, "secret")
+	}
+
+	if _, err := s.PromptEchoOn("login again: "); err == nil {
+		t.Error("expected an error once EchoResponses is exhausted, got nil")
+	}
+	if _, err := s.PromptEchoOff("password again: "); err == nil {
+		t.Error("expected an error once NoEchoResponses is exhausted, got nil")
+	}
+}
+
+func TestScriptedConversationRecordsMessages(t *testing.T) {
+	s := &ScriptedConversation{}
+
+	s.TextInfo("welcome")
+	s.ErrorMsg("uh oh")
+
+	if len(s.Info) != 1 || s.Info[0] != "welcome" {
+		t.Errorf("Info = %v, want [welcome]", s.Info)
+	}
+	if len(s.Errors) != 1 || s.Errors[0] != "uh oh" {
+		t.Errorf("Errors = %v, want [uh oh]", s.Errors)
+	}
+}
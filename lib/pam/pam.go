@@ -16,18 +16,19 @@ package pam
 // extern int _pam_start(void *, const char *, const char *, const struct pam_conv *, pam_handle_t **);
 // extern int _pam_end(void *, pam_handle_t *, int);
 // extern int _pam_authenticate(void *, pam_handle_t *, int);
+// extern int _pam_setcred(void *, pam_handle_t *, int);
+// extern int _pam_chauthtok(void *, pam_handle_t *, int);
 // extern int _pam_acct_mgmt(void *, pam_handle_t *, int);
 // extern int _pam_open_session(void *, pam_handle_t *, int);
 // extern int _pam_close_session(void *, pam_handle_t *, int);
 // extern const char *_pam_strerror(void *, pam_handle_t *, int);
+// extern char **_pam_getenvlist(void *, pam_handle_t *);
+// extern int _pam_set_item(void *, pam_handle_t *, int, const char *);
+// extern int _pam_get_item(void *, pam_handle_t *, int, const char **);
 import "C"
 
 import (
-	"bufio"
-	"bytes"
-	"io"
 	"sync"
-	"syscall"
 	"unsafe"
 
 	"github.com/gravitational/teleport"
@@ -43,12 +44,15 @@ var log = logrus.WithFields(logrus.Fields{
 // handler is used to register and find instances of *PAM at the package level
 // to enable callbacks from C code.
 type handler interface {
-	// writeStream will write to the output stream (stdout or stderr or
-	// equivlient).
-	writeStream(int, string) (int, error)
-
-	// readStream will read from the input stream (stdin or equivlient).
-	readStream(bool) (string, error)
+	// displayMessage shows a PAM conversation message (PAM_TEXT_INFO or
+	// PAM_ERROR_MSG) to the ConversationHandler. For prompt styles
+	// (PAM_PROMPT_ECHO_ON/OFF) it instead stashes the prompt text until the
+	// matching readResponse call arrives.
+	displayMessage(style int, msg string)
+
+	// readResponse collects the ConversationHandler's answer to the prompt
+	// last seen by displayMessage.
+	readResponse(style int) (string, error)
 }
 
 var handlerMu sync.Mutex
@@ -56,7 +60,7 @@ var handlerCount int
 var handlers map[int]handler = make(map[int]handler)
 
 //export writeCallback
-func writeCallback(index C.int, stream C.int, s *C.char) {
+func writeCallback(index C.int, style C.int, s *C.char) {
 	handlerMu.Lock()
 	defer handlerMu.Unlock()
 
@@ -70,12 +74,11 @@ func writeCallback(index C.int, stream C.int, s *C.char) {
 	// should, cap strings to the maximum message size that PAM allows.
 	str := C.GoStringN(s, C.int(C.strnlen(s, C.PAM_MAX_MSG_SIZE)))
 
-	// Write to the stream (typically stdout or stderr or equivlient).
-	handle.writeStream(int(stream), str)
+	handle.displayMessage(int(style), str)
 }
 
 //export readCallback
-func readCallback(index C.int, e C.int) *C.char {
+func readCallback(index C.int, style C.int) *C.char {
 	handlerMu.Lock()
 	defer handlerMu.Unlock()
 
@@ -85,13 +88,7 @@ func readCallback(index C.int, e C.int) *C.char {
 		return nil
 	}
 
-	var echo bool
-	if e == 1 {
-		echo = true
-	}
-
-	// Read from the stream (typically stdin or equivlient).
-	s, err := handle.readStream(echo)
+	s, err := handle.readResponse(int(style))
 	if err != nil {
 		log.Errorf("Unable to read from input stream: %v", err)
 		return nil
@@ -165,17 +162,15 @@ type PAM struct {
 	// retval holds the value returned by the last PAM call.
 	retval C.int
 
-	// stdin is the input stream which the conversation function will use to
-	// obtain data from the user.
-	stdin io.Reader
-
-	// stdout is the output stream which the conversation function will use to
-	// show data to the user.
-	stdout io.Writer
+	// conversation is driven by the C conversation function to satisfy
+	// prompts from the PAM module and to surface informational and error
+	// messages.
+	conversation ConversationHandler
 
-	// stderr is the output stream which the conversation function will use to
-	// report errors to the user.
-	stderr io.Writer
+	// pendingPrompt holds the text of a PAM_PROMPT_ECHO_ON/OFF message seen
+	// by displayMessage until the matching readResponse call collects the
+	// ConversationHandler's answer.
+	pendingPrompt string
 
 	// service_name is the name of the PAM policy to use.
 	service_name *C.char
@@ -185,6 +180,11 @@ type PAM struct {
 
 	// handlerIndex is the index to the package level handler map.
 	handlerIndex int
+
+	// usedPAMAuth is true if pam_authenticate/pam_setcred were used to open
+	// this context. Close uses it to know whether credentials need to be
+	// torn down with pam_setcred(PAM_DELETE_CRED).
+	usedPAMAuth bool
 }
 
 // Open creates a PAM context and initiates a PAM transaction to check the
@@ -194,11 +194,18 @@ func Open(config *Config) (*PAM, error) {
 		return nil, trace.BadParameter("PAM configuration is required.")
 	}
 
+	conversation := config.Conversation
+	if conversation == nil {
+		conversation = &StreamConversation{
+			Stdin:  config.Stdin,
+			Stdout: config.Stdout,
+			Stderr: config.Stderr,
+		}
+	}
+
 	p := &PAM{
-		pamh:   nil,
-		stdin:  config.Stdin,
-		stdout: config.Stdout,
-		stderr: config.Stderr,
+		pamh:         nil,
+		conversation: conversation,
 	}
 
 	// Both config.ServiceName and config.Username convert between Go strings to
@@ -222,14 +229,62 @@ func Open(config *Config) (*PAM, error) {
 		return nil, p.codeToError(p.retval)
 	}
 
+	// Set PAM items describing the login so that modules like pam_access,
+	// pam_time, pam_tally2, and pam_faillock can make decisions (or record
+	// failures) based on where the connection came from.
+	if err := p.setItem(C.PAM_RHOST, config.RemoteHost); err != nil {
+		return nil, p.abort(p.retval)
+	}
+	if err := p.setItem(C.PAM_RUSER, config.RemoteUser); err != nil {
+		return nil, p.abort(p.retval)
+	}
+	if err := p.setItem(C.PAM_TTY, config.TTYName); err != nil {
+		return nil, p.abort(p.retval)
+	}
+	if err := p.setItem(C.PAM_XDISPLAY, config.XDisplay); err != nil {
+		return nil, p.abort(p.retval)
+	}
+
+	// If requested, run the "auth" stack. This authenticates the user (for
+	// example against Kerberos, LDAP, or a second factor like Duo) and then
+	// establishes any credentials (for example a Kerberos ticket cache) that
+	// later modules in the "session" stack may rely on.
+	if config.UsePAMAuth {
+		p.retval = C._pam_authenticate(pamHandle, p.pamh, 0)
+		if p.retval != C.PAM_SUCCESS {
+			return nil, p.abort(p.retval)
+		}
+
+		credentialsFlag := C.int(config.CredentialsFlag)
+		if credentialsFlag == 0 {
+			credentialsFlag = C.PAM_ESTABLISH_CRED
+		}
+		p.retval = C._pam_setcred(pamHandle, p.pamh, credentialsFlag)
+		if p.retval != C.PAM_SUCCESS {
+			return nil, p.abort(p.retval)
+		}
+		p.usedPAMAuth = true
+	}
+
 	// Check that the *nix account is valid. Checking a account varies based off
 	// the PAM modules used in the account stack. Typically this consists of
 	// checking if the account is expired or has access restrictions.
 	//
 	// Note: This function does not perform any authentication!
 	retval := C._pam_acct_mgmt(pamHandle, p.pamh, 0)
+	if retval == C.PAM_NEW_AUTHTOK_REQD && config.AllowPasswordChange {
+		// The account is valid but the password (or other authentication
+		// token) has expired. Drive the module's password-change prompts
+		// through the conversation callbacks and then re-check the account.
+		p.retval = C._pam_chauthtok(pamHandle, p.pamh, C.PAM_CHANGE_EXPIRED_AUTHTOK)
+		if p.retval != C.PAM_SUCCESS {
+			return nil, p.abort(p.retval)
+		}
+
+		retval = C._pam_acct_mgmt(pamHandle, p.pamh, 0)
+	}
 	if retval != C.PAM_SUCCESS {
-		return nil, p.codeToError(retval)
+		return nil, p.abort(retval)
 	}
 
 	// Open a user session. Opening a session varies based off the PAM modules
@@ -237,12 +292,37 @@ func Open(config *Config) (*PAM, error) {
 	// printing the MOTD, mounting a home directory, updating auth.log.
 	p.retval = C._pam_open_session(pamHandle, p.pamh, 0)
 	if p.retval != C.PAM_SUCCESS {
-		return nil, p.codeToError(p.retval)
+		return nil, p.abort(p.retval)
 	}
 
 	return p, nil
 }
 
+// abort tears down a PAM context that failed to fully open. If the "auth"
+// stack already established credentials (p.usedPAMAuth), they are deleted
+// with pam_setcred(PAM_DELETE_CRED) before the transaction ends so that
+// OS-level state a module established (for example a Kerberos ticket
+// cache via pam_krb5) is never left behind just because a later
+// account/session check rejects the login. Returns the error
+// corresponding to retval.
+func (p *PAM) abort(retval C.int) error {
+	err := p.codeToError(retval)
+
+	if p.usedPAMAuth {
+		if delRetval := C._pam_setcred(pamHandle, p.pamh, C.PAM_DELETE_CRED); delRetval != C.PAM_SUCCESS {
+			log.Errorf("Failed to delete PAM credentials during abort: %v", p.codeToError(delRetval))
+		}
+	}
+
+	C._pam_end(pamHandle, p.pamh, retval)
+	C.free(unsafe.Pointer(p.conv))
+	C.free(unsafe.Pointer(p.service_name))
+	C.free(unsafe.Pointer(p.user))
+	unregisterHandler(p.handlerIndex)
+
+	return err
+}
+
 // Close will close the session, the PAM context, and release any allocated
 // memory.
 func (p *PAM) Close() error {
@@ -253,6 +333,15 @@ func (p *PAM) Close() error {
 		return p.codeToError(p.retval)
 	}
 
+	// If the "auth" stack was used to establish credentials, tear them down
+	// before ending the transaction.
+	if p.usedPAMAuth {
+		p.retval = C._pam_setcred(pamHandle, p.pamh, C.PAM_DELETE_CRED)
+		if p.retval != C.PAM_SUCCESS {
+			return p.codeToError(p.retval)
+		}
+	}
+
 	// Terminate the PAM transaction.
 	retval := C._pam_end(pamHandle, p.pamh, p.retval)
 	if retval != C.PAM_SUCCESS {
@@ -272,34 +361,90 @@ func (p *PAM) Close() error {
 	return nil
 }
 
-// writeStream will write to the output stream (stdout or stderr or
-// equivlient).
-func (p *PAM) writeStream(stream int, s string) (int, error) {
-	writer := p.stdout
-	if stream == syscall.Stderr {
-		writer = p.stderr
+// displayMessage routes a PAM conversation message to the ConversationHandler
+// based on its style. PAM_TEXT_INFO and PAM_ERROR_MSG are shown immediately;
+// PAM_PROMPT_ECHO_ON/OFF messages are prompts and are stashed until the
+// matching readResponse call.
+func (p *PAM) displayMessage(style int, msg string) {
+	switch C.int(style) {
+	case C.PAM_TEXT_INFO:
+		p.conversation.TextInfo(msg)
+	case C.PAM_ERROR_MSG:
+		p.conversation.ErrorMsg(msg)
+	default:
+		p.pendingPrompt = msg
 	}
+}
 
-	// Replace \n with \r\n so the message correctly aligned.
-	n, err := writer.Write(bytes.Replace([]byte(s), []byte("\n"), []byte("\r\n"), -1))
-	if err != nil {
-		return n, err
+// readResponse collects the ConversationHandler's answer to the prompt last
+// seen by displayMessage.
+func (p *PAM) readResponse(style int) (string, error) {
+	msg := p.pendingPrompt
+	p.pendingPrompt = ""
+
+	switch C.int(style) {
+	case C.PAM_PROMPT_ECHO_ON:
+		return p.conversation.PromptEchoOn(msg)
+	case C.PAM_PROMPT_ECHO_OFF:
+		return p.conversation.PromptEchoOff(msg)
+	default:
+		return "", trace.BadParameter("unrecognized PAM message style: %v", style)
+	}
+}
+
+// Environment returns the list of environment variables (in "KEY=VALUE"
+// form) that PAM modules have published into the PAM handle with
+// pam_putenv. Modules like pam_env, pam_krb5, and pam_mkhomedir use this to
+// hand credentials (KRB5CCNAME, XDG_RUNTIME_DIR, etc.) to the application.
+// It is the caller's responsibility to append this to the child
+// shell/exec's environment; PAM has no way to do that itself.
+func (p *PAM) Environment() []string {
+	envList := C._pam_getenvlist(pamHandle, p.pamh)
+	if envList == nil {
+		return nil
+	}
+
+	var environment []string
+	for ptr := envList; *ptr != nil; ptr = (**C.char)(unsafe.Pointer(uintptr(unsafe.Pointer(ptr)) + unsafe.Sizeof(ptr))) {
+		environment = append(environment, C.GoString(*ptr))
+		C.free(unsafe.Pointer(*ptr))
 	}
+	C.free(unsafe.Pointer(envList))
 
-	return n, nil
+	return environment
 }
 
-// readStream will read from the input stream (stdin or equivlient).
-// TODO(russjones): At some point in the future if this becomes an issue, we
-// should consider supporting echo = false.
-func (p *PAM) readStream(echo bool) (string, error) {
-	reader := bufio.NewReader(p.stdin)
-	text, err := reader.ReadString('\n')
-	if err != nil {
-		return "", trace.Wrap(err)
+// setItem sets a PAM item, such as PAM_RHOST or PAM_TTY, on the PAM handle.
+// Empty values are skipped so that callers can pass through optional
+// configuration fields unconditionally.
+func (p *PAM) setItem(itemType C.int, value string) error {
+	if value == "" {
+		return nil
+	}
+
+	cs := C.CString(value)
+	defer C.free(unsafe.Pointer(cs))
+
+	p.retval = C._pam_set_item(pamHandle, p.pamh, itemType, cs)
+	if p.retval != C.PAM_SUCCESS {
+		return p.codeToError(p.retval)
+	}
+
+	return nil
+}
+
+// GetItem returns the value of a PAM item, such as PAM_USER, which a module
+// earlier in the stack (for example a username mapping module) may have
+// rewritten.
+func (p *PAM) GetItem(itemType int) (string, error) {
+	var value *C.char
+
+	retval := C._pam_get_item(pamHandle, p.pamh, C.int(itemType), &value)
+	if retval != C.PAM_SUCCESS {
+		return "", p.codeToError(retval)
 	}
 
-	return text, nil
+	return C.GoString(value), nil
 }
 
 // codeToError returns a human readable string from the PAM error.
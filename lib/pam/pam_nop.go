@@ -22,6 +22,18 @@ func (p *PAM) Close() error {
 	return nil
 }
 
+// Environment returns the list of environment variables published by PAM
+// modules. Since this build does not support PAM, it always returns nil.
+func (p *PAM) Environment() []string {
+	return nil
+}
+
+// GetItem returns the value of a PAM item. Since this build does not
+// support PAM, it always returns an empty string.
+func (p *PAM) GetItem(itemType int) (string, error) {
+	return "", nil
+}
+
 // BuildHasPAM returns true if the binary was build with support for PAM
 // compiled in.
 func BuildHasPAM() bool {